@@ -1,8 +1,13 @@
 package ssm
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"hash/fnv"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -10,13 +15,33 @@ import (
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/kelseyhightower/confd/log"
+	"github.com/kelseyhightower/confd/pkg/fetch"
+)
+
+const (
+	defaultStreamName = "test"
+	defaultWatchMode  = "kinesis"
+
+	// fetchWorkers is the number of pkg/fetch workers GetValues spreads
+	// prefixes across, each keeping its own content-version cache so an
+	// unchanged prefix's values are reused from that cache on repeat reads
+	// (the API is still queried for every prefix).
+	fetchWorkers = 16
 )
 
 type Client struct {
 	client        *ssm.SSM
 	clientKinesis *kinesis.Kinesis
+	clientSQS     *sqs.SQS
+
+	streamName string
+	watchMode  string
+	queueURL   string
+
+	pool *fetch.Pool
 }
 
 func New() (*Client, error) {
@@ -29,59 +54,107 @@ func New() (*Client, error) {
 		return nil, err
 	}
 
-	var c *aws.Config
+	var awsConfig *aws.Config
 	if os.Getenv("SSM_LOCAL") != "" {
 		log.Debug("SSM_LOCAL is set")
 		endpoint := "http://localhost:8001"
-		c = &aws.Config{
+		awsConfig = &aws.Config{
 			Endpoint: &endpoint,
 		}
 	} else {
-		c = nil
+		awsConfig = nil
 	}
 
 	// Create the service's client with the session.
-	svc := ssm.New(sess, c)
+	svc := ssm.New(sess, awsConfig)
 	k := kinesis.New(sess)
-	return &Client{
+	q := sqs.New(sess)
+
+	streamName := os.Getenv("SSM_STREAM_NAME")
+	if streamName == "" {
+		streamName = defaultStreamName
+	}
+
+	watchMode := os.Getenv("SSM_WATCH_MODE")
+	if watchMode == "" {
+		watchMode = defaultWatchMode
+	}
+
+	c := &Client{
 		client:        svc,
 		clientKinesis: k,
-	}, nil
+		clientSQS:     q,
+		streamName:    streamName,
+		watchMode:     watchMode,
+		queueURL:      os.Getenv("SSM_QUEUE_URL"),
+	}
+	c.pool = fetch.New(fetchWorkers, c.fetchOne)
+	return c, nil
 }
 
-// GetValues retrieves the values for the given keys from AWS SSM Parameter Store
-func (c *Client) GetValues(keys []string) (map[string]string, error) {
-	vars := make(map[string]string)
-	var err error
-	for _, key := range keys {
-		log.Debug("Processing key=%s", key)
-		var resp map[string]string
-		resp, err = c.getParametersWithPrefix(key)
-		if err != nil {
-			return vars, err
-		}
-		if len(resp) == 0 {
-			resp, err = c.getParameter(key)
-			if err != nil && err.(awserr.Error).Code() != ssm.ErrCodeParameterNotFound {
-				return vars, err
-			}
-		}
-		for k, v := range resp {
-			vars[k] = v
+// GetValues retrieves the values for the given keys from AWS SSM Parameter
+// Store, fetching prefixes in parallel via a pkg/fetch pool. ctx bounds
+// every underlying API call; cancelling it (or letting its deadline lapse)
+// aborts the remaining reads and returns ctx.Err().
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	return c.pool.GetValues(ctx, keys)
+}
+
+// fetchOne is the pkg/fetch adapter for a single key prefix. SSM doesn't
+// expose a cheap aggregate version for a path, so the version is a content
+// hash of the fetched parameters; repeat reads still hit the API, but
+// unchanged results are merged from cache instead of being re-copied.
+func (c *Client) fetchOne(ctx context.Context, key, prevVersion string) (map[string]string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, prevVersion, err
+	}
+
+	log.Debug("Processing key=%s", key)
+	resp, err := c.getParametersWithPrefix(ctx, key)
+	if err != nil {
+		return nil, prevVersion, err
+	}
+	if len(resp) == 0 {
+		resp, err = c.getParameter(ctx, key)
+		if err != nil && err.(awserr.Error).Code() != ssm.ErrCodeParameterNotFound {
+			return nil, prevVersion, err
 		}
 	}
-	return vars, nil
+
+	version := contentVersion(resp)
+	if prevVersion != "" && version == prevVersion {
+		return nil, version, nil
+	}
+	return resp, version, nil
 }
 
-func (c *Client) getParametersWithPrefix(prefix string) (map[string]string, error) {
-	var err error
+// contentVersion hashes a parameter map's sorted contents so fetchOne can
+// tell a pkg/fetch worker whether a prefix's values actually changed.
+func contentVersion(vars map[string]string) string {
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := fnv.New64a()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(vars[k]))
+		h.Write([]byte{0})
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+func (c *Client) getParametersWithPrefix(ctx context.Context, prefix string) (map[string]string, error) {
 	parameters := make(map[string]string)
 	params := &ssm.GetParametersByPathInput{
 		Path:           aws.String(prefix),
 		Recursive:      aws.Bool(true),
 		WithDecryption: aws.Bool(true),
 	}
-	c.client.GetParametersByPathPages(params,
+	err := c.client.GetParametersByPathPagesWithContext(ctx, params,
 		func(page *ssm.GetParametersByPathOutput, lastPage bool) bool {
 			for _, p := range page.Parameters {
 				parameters[*p.Name] = *p.Value
@@ -91,13 +164,13 @@ func (c *Client) getParametersWithPrefix(prefix string) (map[string]string, erro
 	return parameters, err
 }
 
-func (c *Client) getParameter(name string) (map[string]string, error) {
+func (c *Client) getParameter(ctx context.Context, name string) (map[string]string, error) {
 	parameters := make(map[string]string)
 	params := &ssm.GetParameterInput{
 		Name:           aws.String(name),
 		WithDecryption: aws.Bool(true),
 	}
-	resp, err := c.client.GetParameter(params)
+	resp, err := c.client.GetParameterWithContext(ctx, params)
 	if err != nil {
 		return parameters, err
 	}
@@ -121,54 +194,224 @@ type Event struct {
 	} `json:"detail"`
 }
 
-func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex string, stopChan chan bool) (string, error) {
-	log.Debug("Describing stream test")
-	describeStreamOutput, err := c.clientKinesis.DescribeStream(&kinesis.DescribeStreamInput{
-		StreamName: aws.String("test"),
+// WatchPrefix blocks until a Parameter Store change under one of keys is
+// observed or ctx is done, whichever comes first. ctx replaces the previous
+// stopChan plumbing and gates every in-flight goroutine the watch spawns.
+// The watch mode is selected via SSM_WATCH_MODE: "kinesis" (default) tails
+// the stream configured by SSM_STREAM_NAME across all of its shards, "sqs"
+// drains an SQS queue fed by an EventBridge rule on aws.ssm Parameter Store
+// events.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex string) (string, error) {
+	if c.watchMode == "sqs" {
+		return c.watchSQS(ctx, keys, waitIndex)
+	}
+	return c.watchKinesis(ctx, keys, waitIndex)
+}
+
+// shardPositions is the per-shard resume point encoded into waitIndex so a
+// multi-shard stream can be tailed across WatchPrefix calls without losing
+// position in any one shard.
+type shardPositions map[string]string
+
+func decodeShardPositions(waitIndex string) shardPositions {
+	positions := shardPositions{}
+	if waitIndex == "" {
+		return positions
+	}
+	if err := json.Unmarshal([]byte(waitIndex), &positions); err != nil {
+		log.Debug("Discarding unparseable waitIndex %q: %s", waitIndex, err)
+		return shardPositions{}
+	}
+	return positions
+}
+
+func (p shardPositions) encode() string {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+func (c *Client) watchKinesis(ctx context.Context, keys []string, waitIndex string) (string, error) {
+	describeStreamOutput, err := c.clientKinesis.DescribeStreamWithContext(ctx, &kinesis.DescribeStreamInput{
+		StreamName: aws.String(c.streamName),
 	})
 	if err != nil {
 		return waitIndex, err
 	}
-	log.Debug("Trying to get shard iterator for %s", *describeStreamOutput.StreamDescription.Shards[0].ShardId)
-	var shardIterator *string
-	if waitIndex == "" {
-		getShardIteratorOutput, err := c.clientKinesis.GetShardIterator(&kinesis.GetShardIteratorInput{
-			ShardId:           describeStreamOutput.StreamDescription.Shards[0].ShardId,
-			StreamName:        aws.String("test"),
-			ShardIteratorType: aws.String(kinesis.ShardIteratorTypeLatest),
+
+	positions := decodeShardPositions(waitIndex)
+
+	shardCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	recordChan := make(chan *kinesis.Record)
+	positionChan := make(chan shardPosition)
+	errChan := make(chan error, len(describeStreamOutput.StreamDescription.Shards))
+
+	for _, shard := range describeStreamOutput.StreamDescription.Shards {
+		go c.watchShard(shardCtx, *shard.ShardId, positions[*shard.ShardId], recordChan, positionChan, errChan)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return positions.encode(), ctx.Err()
+		case err := <-errChan:
+			return positions.encode(), err
+		case pos := <-positionChan:
+			positions[pos.ShardID] = pos.SequenceNumber
+		case record := <-recordChan:
+			var event Event
+			if err := json.Unmarshal(record.Data, &event); err != nil {
+				return positions.encode(), err
+			}
+			log.Debug("Record data %#v original time %s", event, event.Time)
+			for _, key := range keys {
+				if strings.HasPrefix(event.Detail.Name, key) {
+					return positions.encode(), nil
+				}
+			}
+		}
+	}
+}
+
+type shardPosition struct {
+	ShardID        string
+	SequenceNumber string
+}
+
+// watchShard tails a single Kinesis shard, forwarding records onto
+// recordChan and reporting its last-seen sequence number on positionChan so
+// the caller can resume from it later. Expired iterators are re-resolved
+// from that sequence number (Kinesis iterators expire after 5 minutes).
+// ctx cancellation stops the shard's GetRecords loop.
+func (c *Client) watchShard(ctx context.Context, shardID, sequenceNumber string, recordChan chan *kinesis.Record, positionChan chan shardPosition, errChan chan error) {
+	shardIterator, err := c.getShardIterator(ctx, shardID, sequenceNumber)
+	if err != nil {
+		errChan <- err
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		log.Debug("Getting records for shard %s", shardID)
+		getRecordsOutput, err := c.clientKinesis.GetRecordsWithContext(ctx, &kinesis.GetRecordsInput{
+			ShardIterator: shardIterator,
 		})
 		if err != nil {
-			return waitIndex, err
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == kinesis.ErrCodeExpiredIteratorException && sequenceNumber != "" {
+				log.Debug("Shard iterator for %s expired, re-resolving from sequence number %s", shardID, sequenceNumber)
+				shardIterator, err = c.getShardIterator(ctx, shardID, sequenceNumber)
+				if err != nil {
+					errChan <- err
+					return
+				}
+				continue
+			}
+			errChan <- err
+			return
 		}
-		log.Debug("Got shard iterator %s", *getShardIteratorOutput.ShardIterator)
-		shardIterator = getShardIteratorOutput.ShardIterator
+
+		for _, record := range getRecordsOutput.Records {
+			sequenceNumber = *record.SequenceNumber
+			select {
+			case recordChan <- record:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if sequenceNumber != "" {
+			select {
+			case positionChan <- shardPosition{ShardID: shardID, SequenceNumber: sequenceNumber}:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if getRecordsOutput.NextShardIterator == nil {
+			// The shard has been closed (e.g. after a reshard); nothing more
+			// will ever arrive on it.
+			return
+		}
+		shardIterator = getRecordsOutput.NextShardIterator
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (c *Client) getShardIterator(ctx context.Context, shardID, sequenceNumber string) (*string, error) {
+	input := &kinesis.GetShardIteratorInput{
+		ShardId:    aws.String(shardID),
+		StreamName: aws.String(c.streamName),
+	}
+	if sequenceNumber != "" {
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
+		input.StartingSequenceNumber = aws.String(sequenceNumber)
 	} else {
-		log.Debug("Using previous shard iterator %s", waitIndex)
-		shardIterator = &waitIndex
-		time.Sleep(5 * time.Second)
+		input.ShardIteratorType = aws.String(kinesis.ShardIteratorTypeLatest)
+	}
+
+	out, err := c.clientKinesis.GetShardIteratorWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return out.ShardIterator, nil
+}
+
+// watchSQS drains the SQS queue configured by SSM_QUEUE_URL, which is
+// expected to be fed by an EventBridge rule matching aws.ssm Parameter Store
+// change events - the standard AWS pattern for notifying on Parameter Store
+// writes without polling Kinesis. ctx cancellation stops the receive loop.
+func (c *Client) watchSQS(ctx context.Context, keys []string, waitIndex string) (string, error) {
+	if c.queueURL == "" {
+		return waitIndex, fmt.Errorf("ssm: SSM_WATCH_MODE=sqs requires SSM_QUEUE_URL to be set")
 	}
+
 	for {
-		getRecordsOutput, err := c.clientKinesis.GetRecords(&kinesis.GetRecordsInput{
-			ShardIterator: shardIterator,
+		if err := ctx.Err(); err != nil {
+			return waitIndex, err
+		}
+
+		out, err := c.clientSQS.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(c.queueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(20),
 		})
 		if err != nil {
-			return *shardIterator, err
+			return waitIndex, err
 		}
-		log.Debug("Received records %#v", getRecordsOutput.Records)
-		shardIterator = getRecordsOutput.NextShardIterator
-		var event Event
-		for _, record := range getRecordsOutput.Records {
-			err = json.Unmarshal(record.Data, &event)
+
+		for _, msg := range out.Messages {
+			var event Event
+			if err := json.Unmarshal([]byte(*msg.Body), &event); err != nil {
+				return waitIndex, err
+			}
+
+			_, err := c.clientSQS.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(c.queueURL),
+				ReceiptHandle: msg.ReceiptHandle,
+			})
 			if err != nil {
-				return *shardIterator, err
+				return waitIndex, err
 			}
-			log.Debug("Record data %#v original time %s", event, event.Time)
+
+			log.Debug("Received SQS event %#v", event)
 			for _, key := range keys {
 				if strings.HasPrefix(event.Detail.Name, key) {
-					return *shardIterator, nil
+					return event.ID, nil
 				}
 			}
 		}
-		time.Sleep(5 * time.Second)
 	}
 }
@@ -0,0 +1,44 @@
+package ssm
+
+import "testing"
+
+func TestShardPositionsRoundTrip(t *testing.T) {
+	positions := shardPositions{"shard-1": "49500000", "shard-2": "49600000"}
+
+	got := decodeShardPositions(positions.encode())
+	if len(got) != len(positions) {
+		t.Fatalf("decodeShardPositions(encode()) = %v, want %v", got, positions)
+	}
+	for id, seq := range positions {
+		if got[id] != seq {
+			t.Errorf("decodeShardPositions(encode())[%q] = %q, want %q", id, got[id], seq)
+		}
+	}
+}
+
+func TestDecodeShardPositionsEmptyWaitIndex(t *testing.T) {
+	got := decodeShardPositions("")
+	if len(got) != 0 {
+		t.Fatalf("decodeShardPositions(\"\") = %v, want empty", got)
+	}
+}
+
+func TestDecodeShardPositionsUnparseable(t *testing.T) {
+	got := decodeShardPositions("not json")
+	if len(got) != 0 {
+		t.Fatalf("decodeShardPositions(garbage) = %v, want empty (falls back instead of erroring)", got)
+	}
+}
+
+func TestContentVersionStableAndSensitiveToContent(t *testing.T) {
+	a := map[string]string{"/x": "1", "/y": "2"}
+	b := map[string]string{"/y": "2", "/x": "1"}
+	if contentVersion(a) != contentVersion(b) {
+		t.Fatalf("contentVersion differs across equal maps in different insertion/iteration order")
+	}
+
+	c := map[string]string{"/x": "1", "/y": "3"}
+	if contentVersion(a) == contentVersion(c) {
+		t.Fatalf("contentVersion(a) == contentVersion(c) for maps with different values")
+	}
+}
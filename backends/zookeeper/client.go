@@ -1,78 +1,283 @@
 package zookeeper
 
 import (
+	"context"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/kelseyhightower/confd/log"
+	"github.com/kelseyhightower/confd/pkg/fetch"
 	zk "github.com/samuel/go-zookeeper/zk"
 )
 
+const defaultSessionTimeout = 10 * time.Second
+
+// reconnectBackoff is the delay WatchPrefix waits after a recoverable error
+// before reconnecting and retrying the watch, so a down ensemble isn't
+// hammered with back-to-back reconnect attempts.
+const reconnectBackoff = 1 * time.Second
+
+// maxReconnectAttempts bounds how many watch attempts WatchPrefix makes
+// within a single call (the first one plus one retry after each reconnect,
+// so at most maxReconnectAttempts-1 reconnects) before giving up and
+// returning the error to the caller, instead of retrying forever against an
+// ensemble that never comes back.
+const maxReconnectAttempts = 5
+
+// nodeWalkConcurrency bounds how many Get/Children calls nodeWalk has
+// in flight at once; the go-zookeeper client is safe for concurrent use so
+// this lets large trees load in parallel instead of one round-trip at a time.
+const nodeWalkConcurrency = 32
+
+// fetchWorkers is the number of pkg/fetch workers GetValues spreads prefixes
+// across, each keeping its own Stat.Mzxid cache so unchanged subtrees are
+// skipped on repeat reads.
+const fetchWorkers = 16
+
+// Config holds the settings accepted by NewZookeeperClient.
+type Config struct {
+	// SessionTimeout defaults to defaultSessionTimeout when zero.
+	SessionTimeout time.Duration
+
+	// AuthScheme and AuthData authenticate the session via Conn.AddAuth,
+	// e.g. AuthScheme "digest" with AuthData "user:password". Left empty,
+	// no authentication is added.
+	AuthScheme string
+	AuthData   []byte
+
+	// Chroot, if set, is prefixed to every path so the client operates as if
+	// rooted at that znode.
+	Chroot string
+}
+
 // Client provides a wrapper around the zookeeper client
 type Client struct {
+	machines []string
+	config   Config
+
+	mu     sync.RWMutex
 	client *zk.Conn
+
+	pool *fetch.Pool
 }
 
-func NewZookeeperClient(machines []string) (*Client, error) {
-	c, _, err := zk.Connect(machines, time.Second) //*10)
-	if err != nil {
-		panic(err)
+func NewZookeeperClient(machines []string, config Config) (*Client, error) {
+	c := &Client{machines: machines, config: config}
+	if err := c.connect(); err != nil {
+		return nil, err
 	}
-	return &Client{c}, nil
+	c.pool = fetch.New(fetchWorkers, c.fetchOne)
+	return c, nil
 }
 
-func nodeWalk(prefix string, c *Client, vars map[string]string) error {
-	l, stat, err := c.client.Children(prefix)
+func (c *Client) connect() error {
+	timeout := c.config.SessionTimeout
+	if timeout <= 0 {
+		timeout = defaultSessionTimeout
+	}
+
+	conn, _, err := zk.Connect(c.machines, timeout)
 	if err != nil {
 		return err
 	}
 
-	if stat.NumChildren == 0 {
-		b, _, err := c.client.Get(prefix)
-		if err != nil {
+	if c.config.AuthScheme != "" {
+		if err := conn.AddAuth(c.config.AuthScheme, c.config.AuthData); err != nil {
+			conn.Close()
 			return err
 		}
-		vars[prefix] = string(b)
+	}
+
+	c.mu.Lock()
+	if c.client != nil {
+		c.client.Close()
+	}
+	c.client = conn
+	c.mu.Unlock()
+	return nil
+}
+
+// reconnect tears down the current session (if any) and establishes a new
+// one, used to recover from ErrSessionExpired/ErrConnectionClosed instead of
+// bubbling the error straight up to the caller.
+func (c *Client) reconnect() error {
+	log.Debug("Reconnecting to zookeeper")
+	return c.connect()
+}
+
+func isRecoverable(err error) bool {
+	return err == zk.ErrSessionExpired || err == zk.ErrConnectionClosed
+}
+
+func (c *Client) conn() *zk.Conn {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.client
+}
+
+func (c *Client) path(p string) string {
+	if c.config.Chroot == "" || c.config.Chroot == "/" {
+		return p
+	}
+	if p == "/" || p == "" {
+		return c.config.Chroot
+	}
+	return c.config.Chroot + p
+}
+
+// errCollector records the first error reported to it by any of nodeWalk's
+// concurrent workers.
+type errCollector struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (e *errCollector) set(err error) {
+	e.mu.Lock()
+	if e.err == nil {
+		e.err = err
+	}
+	e.mu.Unlock()
+}
+
+func (e *errCollector) get() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+// zkTreeConn is the subset of *zk.Conn that walkTree needs, narrowed out so
+// its concurrency logic can be unit tested against a fake instead of a live
+// ensemble.
+type zkTreeConn interface {
+	Children(path string) ([]string, *zk.Stat, error)
+	Get(path string) ([]byte, *zk.Stat, error)
+}
+
+// nodeWalk flattens the tree rooted at prefix into vars, using a bounded
+// pool of concurrent Get/Children calls instead of one sequential
+// Exists+Get round-trip per node.
+func (c *Client) nodeWalk(prefix string, vars map[string]string) error {
+	return walkTree(c.conn(), prefix, vars)
+}
+
+func walkTree(conn zkTreeConn, prefix string, vars map[string]string) error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := &errCollector{}
+	sem := make(chan struct{}, nodeWalkConcurrency)
+
+	var walk func(path string)
+	walk = func(path string) {
+		defer wg.Done()
+
+		sem <- struct{}{}
+		children, stat, err := conn.Children(path)
+		<-sem
+		if err != nil {
+			errs.set(err)
+			return
+		}
 
-	} else {
-		for _, key := range l {
-			s := prefix + "/" + key
-			_, stat, err := c.client.Exists(s)
+		if stat.NumChildren == 0 {
+			sem <- struct{}{}
+			b, _, err := conn.Get(path)
+			<-sem
 			if err != nil {
-				return err
-			}
-			if stat.NumChildren == 0 {
-				b, _, err := c.client.Get(s)
-				if err != nil {
-					return err
-				}
-				vars[s] = string(b)
-			} else {
-				nodeWalk(s, c, vars)
+				errs.set(err)
+				return
 			}
+			mu.Lock()
+			vars[path] = string(b)
+			mu.Unlock()
+			return
+		}
+
+		for _, child := range children {
+			wg.Add(1)
+			go walk(path + "/" + child)
 		}
 	}
-	return nil
+
+	wg.Add(1)
+	go walk(prefix)
+	wg.Wait()
+
+	return errs.get()
+}
+
+// GetValues fetches each key's subtree in parallel via a pkg/fetch pool,
+// which also lets unchanged subtrees (by Stat.Mzxid) be skipped on repeat
+// calls against the same Client.
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	return c.pool.GetValues(ctx, keys)
 }
 
-func (c *Client) GetValues(keys []string) (map[string]string, error) {
+// fetchOne is the pkg/fetch adapter for a single key: it checks the node's
+// Stat.Mzxid first and skips the (potentially large) nodeWalk entirely when
+// it matches prevVersion.
+func (c *Client) fetchOne(ctx context.Context, key, prevVersion string) (map[string]string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, prevVersion, err
+	}
+
+	v := strings.Replace(key, "/*", "", -1)
+	p := c.path(v)
+
+	exists, stat, err := c.existsWithRetry(p)
+	if err != nil {
+		return nil, prevVersion, err
+	}
+
+	var version string
+	if exists && stat != nil {
+		version = strconv.FormatInt(stat.Mzxid, 10)
+		if prevVersion != "" && version == prevVersion {
+			return nil, version, nil
+		}
+	}
+
+	if p == "/" {
+		p = ""
+	}
+
 	vars := make(map[string]string)
-	for _, v := range keys {
-		v = strings.Replace(v, "/*", "", -1)
-		_, _, err := c.client.Exists(v)
-		if err != nil {
-			return vars, err
+	if err := c.nodeWalkWithRetry(p, vars); err != nil {
+		return nil, prevVersion, err
+	}
+	if root := c.path("/"); root != "/" {
+		unrooted := make(map[string]string, len(vars))
+		for k, val := range vars {
+			unrooted[strings.TrimPrefix(k, root)] = val
 		}
-		if v == "/" {
-			v = ""
+		vars = unrooted
+	}
+	return vars, version, nil
+}
+
+func (c *Client) existsWithRetry(p string) (bool, *zk.Stat, error) {
+	exists, stat, err := c.conn().Exists(p)
+	if err != nil && isRecoverable(err) {
+		if rerr := c.reconnect(); rerr != nil {
+			return false, nil, rerr
 		}
-		err = nodeWalk(v, c, vars)
-		if err != nil {
-			return vars, err
+		exists, stat, err = c.conn().Exists(p)
+	}
+	return exists, stat, err
+}
+
+func (c *Client) nodeWalkWithRetry(prefix string, vars map[string]string) error {
+	err := c.nodeWalk(prefix, vars)
+	if err != nil && isRecoverable(err) {
+		if rerr := c.reconnect(); rerr != nil {
+			return rerr
 		}
+		err = c.nodeWalk(prefix, vars)
 	}
-	return vars, nil
+	return err
 }
 
 type watchResponse struct {
@@ -80,14 +285,16 @@ type watchResponse struct {
 	err       error
 }
 
-func (c *Client) watch(key string, respChan chan watchResponse, cancelRoutine chan bool) {
-	_, _, keyEventCh, err := c.client.GetW(key)
+func (c *Client) watch(ctx context.Context, key string, respChan chan watchResponse) {
+	_, _, keyEventCh, err := c.conn().GetW(c.path(key))
 	if err != nil {
 		respChan <- watchResponse{"", err}
+		return
 	}
-	_, _, childEventCh, err := c.client.ChildrenW(key)
+	_, _, childEventCh, err := c.conn().ChildrenW(c.path(key))
 	if err != nil {
 		respChan <- watchResponse{"", err}
+		return
 	}
 
 	for {
@@ -100,7 +307,7 @@ func (c *Client) watch(key string, respChan chan watchResponse, cancelRoutine ch
 			if e.Type == zk.EventNodeChildrenChanged {
 				respChan <- watchResponse{"", e.Err}
 			}
-		case <-cancelRoutine:
+		case <-ctx.Done():
 			log.Debug("Stop watching: " + key)
 			// There is no way to stop GetW/ChildrenW so just quit
 			return
@@ -108,27 +315,72 @@ func (c *Client) watch(key string, respChan chan watchResponse, cancelRoutine ch
 	}
 }
 
-func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex string, stopChan chan bool) (string, error) {
+// WatchPrefix blocks until a node under prefix changes or ctx is done,
+// whichever comes first. ctx replaces the previous stopChan/cancelRoutine
+// plumbing: cancelling it tears down every watch goroutine spawned below
+// through the same done channel. A session loss mid-watch (ErrSessionExpired
+// / ErrConnectionClosed) triggers a reconnect and retries the watch, backing
+// off reconnectBackoff between attempts (zk.Connect can return before the
+// session is actually established, so retrying immediately risks hammering a
+// down ensemble) up to maxReconnectAttempts before giving up.
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex string) (string, error) {
+	return withReconnect(ctx, maxReconnectAttempts, reconnectBackoff, waitIndex, c.reconnect, func() (string, error) {
+		return c.watchPrefixOnce(ctx, prefix, keys, waitIndex)
+	})
+}
+
+// withReconnect runs attempt, retrying up to maxAttempts times whenever it
+// fails with a recoverable error: it waits backoff (or returns fallback if
+// ctx is done first) then calls reconnect before trying again. This is
+// pulled out of WatchPrefix as a plain function of its inputs so the
+// retry/backoff bookkeeping can be unit tested without a live ensemble.
+func withReconnect(ctx context.Context, maxAttempts int, backoff time.Duration, fallback string, reconnect func() error, attempt func() (string, error)) (string, error) {
+	for i := 0; ; i++ {
+		result, err := attempt()
+		if err == nil || !isRecoverable(err) {
+			return result, err
+		}
+		if i >= maxAttempts-1 {
+			return result, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return fallback, ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		if rerr := reconnect(); rerr != nil {
+			return fallback, rerr
+		}
+	}
+}
+
+// watchPrefixOnce is the single-attempt body WatchPrefix retries with
+// backoff: it lists prefix, sets up watches on every matching key and its
+// parent directories, and blocks for the first change or recoverable error.
+func (c *Client) watchPrefixOnce(ctx context.Context, prefix string, keys []string, waitIndex string) (string, error) {
 	// List the childrens first
-	entries, err := c.GetValues([]string{prefix})
+	entries, err := c.GetValues(ctx, []string{prefix})
 	if err != nil {
 		return waitIndex, err
 	}
 
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	respChan := make(chan watchResponse)
-	cancelRoutine := make(chan bool)
-	defer close(cancelRoutine)
 
 	//watch all subfolders for changes
 	watchMap := make(map[string]string)
-	for k, _ := range entries {
+	for k := range entries {
 		for _, v := range keys {
 			if strings.HasPrefix(k, v) {
 				for dir := filepath.Dir(k); dir != "/"; dir = filepath.Dir(dir) {
 					if _, ok := watchMap[dir]; !ok {
 						watchMap[dir] = ""
 						log.Debug("Watching: " + dir)
-						go c.watch(dir, respChan, cancelRoutine)
+						go c.watch(watchCtx, dir, respChan)
 					}
 				}
 				break
@@ -137,22 +389,20 @@ func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex string, sto
 	}
 
 	//watch all keys in prefix for changes
-	for k, _ := range entries {
+	for k := range entries {
 		for _, v := range keys {
 			if strings.HasPrefix(k, v) {
 				log.Debug("Watching: " + k)
-				go c.watch(k, respChan, cancelRoutine)
+				go c.watch(watchCtx, k, respChan)
 				break
 			}
 		}
 	}
 
-	for {
-		select {
-		case <-stopChan:
-			return waitIndex, nil
-		case r := <-respChan:
-			return r.waitIndex, r.err
-		}
+	select {
+	case <-ctx.Done():
+		return waitIndex, ctx.Err()
+	case r := <-respChan:
+		return r.waitIndex, r.err
 	}
 }
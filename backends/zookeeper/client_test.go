@@ -0,0 +1,228 @@
+package zookeeper
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	zk "github.com/samuel/go-zookeeper/zk"
+)
+
+// fakeZKConn is an in-memory zkTreeConn backed by a flat path->children/value
+// map, letting walkTree's concurrency be exercised without a live ensemble.
+type fakeZKConn struct {
+	mu       sync.Mutex
+	children map[string][]string
+	values   map[string]string
+	errs     map[string]error
+}
+
+func (f *fakeZKConn) Children(path string) ([]string, *zk.Stat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err, ok := f.errs[path]; ok {
+		return nil, nil, err
+	}
+	children := f.children[path]
+	return children, &zk.Stat{NumChildren: int32(len(children))}, nil
+}
+
+func (f *fakeZKConn) Get(path string) ([]byte, *zk.Stat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err, ok := f.errs[path]; ok {
+		return nil, nil, err
+	}
+	return []byte(f.values[path]), &zk.Stat{}, nil
+}
+
+func TestWalkTreeFlattensNestedNodes(t *testing.T) {
+	conn := &fakeZKConn{
+		children: map[string][]string{
+			"/app":      {"a", "b"},
+			"/app/a":    {"nested"},
+			"/app/a/nested": nil,
+			"/app/b":    nil,
+		},
+		values: map[string]string{
+			"/app/a/nested": "1",
+			"/app/b":        "2",
+		},
+	}
+
+	vars := map[string]string{}
+	if err := walkTree(conn, "/app", vars); err != nil {
+		t.Fatalf("walkTree: %v", err)
+	}
+
+	want := map[string]string{"/app/a/nested": "1", "/app/b": "2"}
+	if len(vars) != len(want) {
+		t.Fatalf("walkTree vars = %v, want %v", vars, want)
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Fatalf("walkTree vars[%q] = %q, want %q", k, vars[k], v)
+		}
+	}
+}
+
+func TestWalkTreePropagatesChildError(t *testing.T) {
+	boom := errors.New("boom")
+	conn := &fakeZKConn{
+		children: map[string][]string{
+			"/app":   {"a", "b"},
+			"/app/a": nil,
+			"/app/b": nil,
+		},
+		values: map[string]string{"/app/a": "1"},
+		errs:   map[string]error{"/app/b": boom},
+	}
+
+	vars := map[string]string{}
+	err := walkTree(conn, "/app", vars)
+	if err != boom {
+		t.Fatalf("walkTree err = %v, want %v", err, boom)
+	}
+	// The sibling that succeeded before the error was hit should still be
+	// merged in, matching nodeWalk's partial-result behavior elsewhere.
+	if vars["/app/a"] != "1" {
+		t.Fatalf("walkTree vars = %v, want /app/a=1 despite sibling error", vars)
+	}
+}
+
+func TestIsRecoverable(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{zk.ErrSessionExpired, true},
+		{zk.ErrConnectionClosed, true},
+		{errors.New("some other error"), false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		if got := isRecoverable(c.err); got != c.want {
+			t.Errorf("isRecoverable(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestErrCollectorKeepsFirstError(t *testing.T) {
+	e := &errCollector{}
+	first := errors.New("first")
+	second := errors.New("second")
+
+	e.set(first)
+	e.set(second)
+
+	if got := e.get(); got != first {
+		t.Fatalf("errCollector.get() = %v, want %v (first error wins)", got, first)
+	}
+}
+
+func TestClientPathChroot(t *testing.T) {
+	cases := []struct {
+		chroot string
+		path   string
+		want   string
+	}{
+		{"", "/foo", "/foo"},
+		{"/", "/foo", "/foo"},
+		{"/root", "/foo", "/root/foo"},
+		{"/root", "/", "/root"},
+		{"/root", "", "/root"},
+	}
+	for _, c := range cases {
+		client := &Client{config: Config{Chroot: c.chroot}}
+		if got := client.path(c.path); got != c.want {
+			t.Errorf("path(%q) with chroot %q = %q, want %q", c.path, c.chroot, got, c.want)
+		}
+	}
+}
+
+func TestWithReconnectStopsOnNonRecoverableError(t *testing.T) {
+	boom := errors.New("not recoverable")
+	reconnectCalls := 0
+	attempts := 0
+
+	result, err := withReconnect(context.Background(), 5, time.Millisecond, "fallback",
+		func() error { reconnectCalls++; return nil },
+		func() (string, error) { attempts++; return "idx", boom })
+
+	if err != boom || result != "idx" {
+		t.Fatalf("withReconnect = (%q, %v), want (\"idx\", %v)", result, err, boom)
+	}
+	if attempts != 1 {
+		t.Fatalf("attempt called %d times, want 1 (non-recoverable errors don't retry)", attempts)
+	}
+	if reconnectCalls != 0 {
+		t.Fatalf("reconnect called %d times, want 0", reconnectCalls)
+	}
+}
+
+func TestWithReconnectRetriesRecoverableErrorUpToCap(t *testing.T) {
+	attempts := 0
+	reconnectCalls := 0
+
+	_, err := withReconnect(context.Background(), 3, time.Millisecond, "fallback",
+		func() error { reconnectCalls++; return nil },
+		func() (string, error) { attempts++; return "", zk.ErrSessionExpired })
+
+	if err != zk.ErrSessionExpired {
+		t.Fatalf("withReconnect err = %v, want %v", err, zk.ErrSessionExpired)
+	}
+	if attempts != 3 {
+		t.Fatalf("attempt called %d times, want 3 (maxAttempts)", attempts)
+	}
+	if reconnectCalls != 2 {
+		t.Fatalf("reconnect called %d times, want 2 (once between each retry)", reconnectCalls)
+	}
+}
+
+func TestWithReconnectSucceedsAfterRetry(t *testing.T) {
+	attempts := 0
+
+	result, err := withReconnect(context.Background(), 5, time.Millisecond, "fallback",
+		func() error { return nil },
+		func() (string, error) {
+			attempts++
+			if attempts < 3 {
+				return "", zk.ErrConnectionClosed
+			}
+			return "ok", nil
+		})
+
+	if err != nil || result != "ok" {
+		t.Fatalf("withReconnect = (%q, %v), want (\"ok\", nil)", result, err)
+	}
+	if attempts != 3 {
+		t.Fatalf("attempt called %d times, want 3", attempts)
+	}
+}
+
+func TestWithReconnectStopsWhenReconnectFails(t *testing.T) {
+	reconnectErr := errors.New("reconnect failed")
+
+	result, err := withReconnect(context.Background(), 5, time.Millisecond, "fallback",
+		func() error { return reconnectErr },
+		func() (string, error) { return "", zk.ErrSessionExpired })
+
+	if err != reconnectErr || result != "fallback" {
+		t.Fatalf("withReconnect = (%q, %v), want (\"fallback\", %v)", result, err, reconnectErr)
+	}
+}
+
+func TestWithReconnectStopsOnContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	result, err := withReconnect(ctx, 5, time.Hour, "fallback",
+		func() error { return nil },
+		func() (string, error) { return "", zk.ErrSessionExpired })
+
+	if err != context.Canceled || result != "fallback" {
+		t.Fatalf("withReconnect = (%q, %v), want (\"fallback\", %v)", result, err, context.Canceled)
+	}
+}
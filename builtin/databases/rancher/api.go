@@ -0,0 +1,272 @@
+package rancher
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kelseyhightower/confd/log"
+)
+
+const defaultAPIEndpoint = "http://rancher-metadata/v2-beta"
+
+// apiProvider talks to the Rancher Cattle REST API instead of the metadata
+// service. It walks stacks/services/containers/hosts into the same
+// key-space that treeWalk produces from the metadata JSON, so templates
+// written against the metadata provider keep working unchanged.
+type apiProvider struct {
+	endpoint   string
+	accessKey  string
+	secretKey  string
+	httpClient *http.Client
+}
+
+func newAPIProvider(config Config) (*apiProvider, error) {
+	endpoint := config.APIEndpoint
+	if endpoint == "" {
+		endpoint = defaultAPIEndpoint
+	}
+	log.Debug("Using Rancher API endpoint: %s", endpoint)
+
+	return &apiProvider{
+		endpoint:   strings.TrimRight(endpoint, "/"),
+		accessKey:  config.AccessKey,
+		secretKey:  config.SecretKey,
+		httpClient: &http.Client{},
+	}, nil
+}
+
+type cattleCollection struct {
+	Data []map[string]interface{} `json:"data"`
+}
+
+func (p *apiProvider) get(ctx context.Context, path string) (*cattleCollection, error) {
+	req, err := http.NewRequest("GET", p.endpoint+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(p.accessKey, p.secretKey)
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var c cattleCollection
+	if err := json.Unmarshal(body, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func cattleItemName(item map[string]interface{}) string {
+	if name, ok := item["name"].(string); ok && name != "" {
+		return name
+	}
+	if id, ok := item["id"].(string); ok {
+		return id
+	}
+	return ""
+}
+
+// buildTree fetches stacks, their services, each service's containers, and
+// hosts, assembling them into the same nested shape the metadata service
+// returns so treeWalk can flatten it unmodified.
+func (p *apiProvider) buildTree(ctx context.Context) (map[string]interface{}, error) {
+	stacks, err := p.get(ctx, "/stacks")
+	if err != nil {
+		return nil, err
+	}
+
+	stacksTree := map[string]interface{}{}
+	for _, stack := range stacks.Data {
+		services, err := p.get(ctx, fmt.Sprintf("/stacks/%v/services", stack["id"]))
+		if err != nil {
+			return nil, err
+		}
+
+		servicesTree := map[string]interface{}{}
+		for _, svc := range services.Data {
+			containers, err := p.get(ctx, fmt.Sprintf("/services/%v/instances", svc["id"]))
+			if err != nil {
+				return nil, err
+			}
+			// treeWalk only descends into []interface{}, not []map[string]interface{}.
+			items := make([]interface{}, len(containers.Data))
+			for i, container := range containers.Data {
+				items[i] = container
+			}
+			svc["containers"] = items
+			servicesTree[cattleItemName(svc)] = svc
+		}
+		stack["services"] = servicesTree
+		stacksTree[cattleItemName(stack)] = stack
+	}
+
+	hosts, err := p.get(ctx, "/hosts")
+	if err != nil {
+		return nil, err
+	}
+	hostsTree := map[string]interface{}{}
+	for _, host := range hosts.Data {
+		hostsTree[cattleItemName(host)] = host
+	}
+
+	return map[string]interface{}{
+		"stacks": stacksTree,
+		"hosts":  hostsTree,
+	}, nil
+}
+
+// subTree walks a "/"-separated key into the tree produced by buildTree.
+func subTree(tree map[string]interface{}, key string) (interface{}, error) {
+	var cur interface{} = tree
+	for _, part := range strings.Split(strings.Trim(key, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("rancher: key %q not found", key)
+		}
+		cur, ok = m[part]
+		if !ok {
+			return nil, fmt.Errorf("rancher: key %q not found", key)
+		}
+	}
+	return cur, nil
+}
+
+func (p *apiProvider) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := map[string]string{}
+
+	tree, err := p.buildTree(ctx)
+	if err != nil {
+		return vars, err
+	}
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return vars, err
+		}
+
+		val, err := subTree(tree, key)
+		if err != nil {
+			return vars, err
+		}
+		if err := treeWalk(key, val, vars); err != nil {
+			return vars, err
+		}
+	}
+	return vars, nil
+}
+
+// eventDebounce bounds how long WatchPrefix waits after a resource.change
+// event for more of the same burst to arrive before re-fetching keys. The
+// stream fires resource.change for every resource in the account, so without
+// this a single burst of unrelated changes would rebuild the whole Cattle
+// tree once per message instead of once per burst.
+const eventDebounce = 500 * time.Millisecond
+
+// WatchPrefix subscribes to the Cattle websocket event stream and returns as
+// soon as a resource.change event leaves a watched key's value different
+// from before, or ctx is done, whichever comes first - giving push semantics
+// instead of the metadata provider's polling/long-polling. Bursts of events
+// are coalesced (via eventDebounce) into a single re-fetch, which is then
+// diffed against the previous values (via keysChanged, shared with
+// metadataProvider.WatchPrefix) rather than treated as a change itself;
+// unrelated bursts just update the baseline and the loop continues.
+func (p *apiProvider) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex string) (string, error) {
+	before, err := p.GetValues(ctx, keys)
+	if err != nil {
+		return waitIndex, err
+	}
+
+	wsURL := strings.Replace(p.endpoint, "http", "ws", 1) + "/subscribe?eventNames=resource.change"
+
+	header := http.Header{}
+	header.Set("Authorization", "Basic "+basicAuthToken(p.accessKey, p.secretKey))
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, header)
+	if err != nil {
+		return waitIndex, err
+	}
+	defer conn.Close()
+
+	msgChan := make(chan []byte)
+	errChan := make(chan error, 1)
+	go func() {
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				errChan <- err
+				return
+			}
+			msgChan <- msg
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return waitIndex, ctx.Err()
+		case err := <-errChan:
+			return waitIndex, err
+		case <-msgChan:
+			if err := debounce(ctx, msgChan, errChan); err != nil {
+				return waitIndex, err
+			}
+
+			after, err := p.GetValues(ctx, keys)
+			if err != nil {
+				return waitIndex, err
+			}
+			if keysChanged(before, after) {
+				return strconv.FormatInt(time.Now().Unix(), 10), nil
+			}
+			before = after
+		}
+	}
+}
+
+// debounce drains msgChan until eventDebounce passes without a new message,
+// coalescing a burst of events into a single caller-side re-fetch.
+func debounce(ctx context.Context, msgChan <-chan []byte, errChan <-chan error) error {
+	timer := time.NewTimer(eventDebounce)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errChan:
+			return err
+		case <-msgChan:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(eventDebounce)
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+func basicAuthToken(accessKey, secretKey string) string {
+	return base64.StdEncoding.EncodeToString([]byte(accessKey + ":" + secretKey))
+}
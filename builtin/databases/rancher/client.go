@@ -1,25 +1,47 @@
 package rancher
 
 import (
-	"encoding/json"
-	"io/ioutil"
-	"log"
-	"net/http"
-	"reflect"
-	"strconv"
-	"strings"
-	"time"
+	"context"
 
 	"github.com/mitchellh/mapstructure"
 )
 
-const (
-	MetaDataURL = "http://rancher-metadata"
-)
+// Config holds the settings accepted by Configure. Source selects which
+// provider backs GetValues/WatchPrefix: "metadata" (the default) talks to
+// the unauthenticated Rancher Metadata service, "api" talks to the Cattle
+// REST API.
+type Config struct {
+	BackendNodes string
+
+	// MetadataPoll, when set to a truthy value ("true", "1", ...), makes the
+	// metadata provider's WatchPrefix fall back to fixed-interval polling
+	// instead of long-polling the metadata service.
+	MetadataPoll string
+
+	// RefreshSeconds controls the polling interval used when MetadataPoll is
+	// enabled. Defaults to defaultRefreshSeconds.
+	RefreshSeconds string
+
+	// Source selects the provider: "metadata" (default) or "api".
+	Source string
+
+	// APIEndpoint, AccessKey and SecretKey configure the Cattle API
+	// provider. Only used when Source is "api".
+	APIEndpoint string
+	AccessKey   string
+	SecretKey   string
+}
+
+// provider is implemented by each of the Rancher data sources (metadata
+// service, Cattle API) so the Client can pick one at Configure time without
+// the rest of confd (or templates) needing to know which is in use.
+type provider interface {
+	GetValues(ctx context.Context, keys []string) (map[string]string, error)
+	WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex string) (string, error)
+}
 
 type Client struct {
-	url        string
-	httpClient *http.Client
+	provider provider
 }
 
 func (c *Client) Configure(configRaw map[string]string) error {
@@ -28,97 +50,27 @@ func (c *Client) Configure(configRaw map[string]string) error {
 		return err
 	}
 
-	url := MetaDataURL
-	if len(strings.Split(config.BackendNodes, ",")) > 0 {
-		url = "http://" + strings.Split(config.BackendNodes, ",")[0]
-	}
-
-	log.Printf("Using Rancher Metadata URL: " + url)
-	c.url = url
-	c.httpClient = &http.Client{}
-	return c.testConnection()
-}
-
-func (c *Client) GetValues(keys []string) (map[string]string, error) {
-	vars := map[string]string{}
-
-	for _, key := range keys {
-		body, err := c.makeMetaDataRequest(key)
+	switch config.Source {
+	case "api":
+		p, err := newAPIProvider(config)
 		if err != nil {
-			return vars, err
-		}
-
-		var jsonResponse interface{}
-		if err = json.Unmarshal(body, &jsonResponse); err != nil {
-			return vars, err
+			return err
 		}
-
-		if err = treeWalk(key, jsonResponse, vars); err != nil {
-			return vars, err
-		}
-	}
-	return vars, nil
-}
-
-func treeWalk(root string, val interface{}, vars map[string]string) error {
-	switch val.(type) {
-	case map[string]interface{}:
-		for k := range val.(map[string]interface{}) {
-			treeWalk(strings.Join([]string{root, k}, "/"), val.(map[string]interface{})[k], vars)
-		}
-	case []interface{}:
-		for i, item := range val.([]interface{}) {
-			idx := strconv.Itoa(i)
-			if i, isMap := item.(map[string]interface{}); isMap {
-				if name, exists := i["name"]; exists {
-					idx = name.(string)
-				}
-			}
-
-			treeWalk(strings.Join([]string{root, idx}, "/"), item, vars)
-		}
-	case bool:
-		vars[root] = strconv.FormatBool(val.(bool))
-	case string:
-		vars[root] = val.(string)
-	case float64:
-		vars[root] = strconv.FormatFloat(val.(float64), 'f', -1, 64)
-	case nil:
-		vars[root] = "null"
+		c.provider = p
 	default:
-		log.Printf("Unknown type: " + reflect.TypeOf(val).Name())
+		p, err := newMetadataProvider(config)
+		if err != nil {
+			return err
+		}
+		c.provider = p
 	}
 	return nil
 }
 
-func (c *Client) makeMetaDataRequest(path string) ([]byte, error) {
-	req, _ := http.NewRequest("GET", strings.Join([]string{c.url, path}, ""), nil)
-	req.Header.Set("Accept", "application/json")
-
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	return ioutil.ReadAll(resp.Body)
-}
-
-func (c *Client) testConnection() error {
-	var err error
-	maxTime := 20 * time.Second
-
-	for i := 1 * time.Second; i < maxTime; i *= time.Duration(2) {
-		if _, err = c.makeMetaDataRequest("/"); err != nil {
-			time.Sleep(i)
-		} else {
-			return nil
-		}
-	}
-	return err
+func (c *Client) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	return c.provider.GetValues(ctx, keys)
 }
 
-func (c *Client) WatchPrefix(prefix string, keys []string, waitIndex uint64) (uint64, error) {
-	// Watches are not implemented in Rancher Metadata Service
-	return 0, nil
+func (c *Client) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex string) (string, error) {
+	return c.provider.WatchPrefix(ctx, prefix, keys, waitIndex)
 }
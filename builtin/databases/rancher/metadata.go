@@ -0,0 +1,259 @@
+package rancher
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MetaDataURL = "http://rancher-metadata"
+
+	// defaultRefreshSeconds is used when MetadataPoll is enabled but
+	// RefreshSeconds is not set (or fails to parse).
+	defaultRefreshSeconds = 30
+
+	// minLongPollRetryDelay is the minimum wait longPollUntilChanged enforces
+	// between iterations whenever the metadata service doesn't advance
+	// waitIndex, so a missing/older service (no X-Rancher-Metadata-Version
+	// header) can't spin the loop at 100% CPU hammering "/" with no backoff.
+	minLongPollRetryDelay = 1 * time.Second
+)
+
+// metadataProvider talks to the unauthenticated Rancher Metadata service.
+type metadataProvider struct {
+	url            string
+	httpClient     *http.Client
+	metadataPoll   bool
+	refreshSeconds time.Duration
+}
+
+func newMetadataProvider(config Config) (*metadataProvider, error) {
+	url := MetaDataURL
+	if len(strings.Split(config.BackendNodes, ",")) > 0 {
+		url = "http://" + strings.Split(config.BackendNodes, ",")[0]
+	}
+	log.Printf("Using Rancher Metadata URL: " + url)
+
+	p := &metadataProvider{
+		url:        url,
+		httpClient: &http.Client{},
+	}
+
+	if poll, err := strconv.ParseBool(config.MetadataPoll); err == nil {
+		p.metadataPoll = poll
+	}
+
+	p.refreshSeconds = defaultRefreshSeconds * time.Second
+	if seconds, err := strconv.Atoi(config.RefreshSeconds); err == nil && seconds > 0 {
+		p.refreshSeconds = time.Duration(seconds) * time.Second
+	}
+
+	if err := p.testConnection(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *metadataProvider) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	return p.fetchKeys(ctx, keys)
+}
+
+// fetchKeys walks each of the given metadata paths and flattens them into a
+// single key/value map, as produced by treeWalk.
+func (p *metadataProvider) fetchKeys(ctx context.Context, keys []string) (map[string]string, error) {
+	vars := map[string]string{}
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return vars, err
+		}
+
+		body, err := p.makeMetaDataRequest(ctx, key)
+		if err != nil {
+			return vars, err
+		}
+
+		var jsonResponse interface{}
+		if err := json.Unmarshal(body, &jsonResponse); err != nil {
+			return vars, err
+		}
+
+		if err := treeWalk(key, jsonResponse, vars); err != nil {
+			return vars, err
+		}
+	}
+	return vars, nil
+}
+
+func treeWalk(root string, val interface{}, vars map[string]string) error {
+	switch val.(type) {
+	case map[string]interface{}:
+		for k := range val.(map[string]interface{}) {
+			treeWalk(strings.Join([]string{root, k}, "/"), val.(map[string]interface{})[k], vars)
+		}
+	case []interface{}:
+		for i, item := range val.([]interface{}) {
+			idx := strconv.Itoa(i)
+			if i, isMap := item.(map[string]interface{}); isMap {
+				if name, exists := i["name"]; exists {
+					idx = name.(string)
+				}
+			}
+
+			treeWalk(strings.Join([]string{root, idx}, "/"), item, vars)
+		}
+	case bool:
+		vars[root] = strconv.FormatBool(val.(bool))
+	case string:
+		vars[root] = val.(string)
+	case float64:
+		vars[root] = strconv.FormatFloat(val.(float64), 'f', -1, 64)
+	case nil:
+		vars[root] = "null"
+	default:
+		log.Printf("Unknown type: " + reflect.TypeOf(val).Name())
+	}
+	return nil
+}
+
+func (p *metadataProvider) makeMetaDataRequest(ctx context.Context, path string) ([]byte, error) {
+	body, _, err := p.doMetaDataRequest(ctx, path, "")
+	return body, err
+}
+
+// doMetaDataRequest issues a GET against the metadata service. When waitIndex
+// is non-empty the request long-polls via wait=true&value=<waitIndex>, and
+// the metadata version the server answered with is returned as the second
+// value (read from the X-Rancher-Metadata-Version response header). ctx
+// bounds the request and cancels it if the caller gives up waiting.
+func (p *metadataProvider) doMetaDataRequest(ctx context.Context, path, waitIndex string) ([]byte, string, error) {
+	url := strings.Join([]string{p.url, path}, "")
+	if waitIndex != "" {
+		url = url + "?wait=true&value=" + waitIndex
+	}
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, waitIndex, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, waitIndex, err
+	}
+
+	newIndex := resp.Header.Get("X-Rancher-Metadata-Version")
+	if newIndex == "" {
+		newIndex = waitIndex
+	}
+	return body, newIndex, nil
+}
+
+func (p *metadataProvider) testConnection() error {
+	var err error
+	maxTime := 20 * time.Second
+
+	for i := 1 * time.Second; i < maxTime; i *= time.Duration(2) {
+		if _, err = p.makeMetaDataRequest(context.Background(), "/"); err != nil {
+			time.Sleep(i)
+		} else {
+			return nil
+		}
+	}
+	return err
+}
+
+// WatchPrefix blocks until a key under one of the given prefixes changes or
+// ctx is done, whichever comes first, then returns the new waitIndex. With
+// MetadataPoll unset it long-polls the metadata root
+// (wait=true&value=<waitIndex>); with MetadataPoll set it falls back to
+// polling every RefreshSeconds. Either way a re-fetch of keys is diffed
+// against the previously observed values so unrelated changes elsewhere in
+// the tree don't trigger a spurious reload.
+func (p *metadataProvider) WatchPrefix(ctx context.Context, prefix string, keys []string, waitIndex string) (string, error) {
+	before, err := p.fetchKeys(ctx, keys)
+	if err != nil {
+		return waitIndex, err
+	}
+
+	if p.metadataPoll {
+		return p.pollUntilChanged(ctx, keys, before, waitIndex)
+	}
+	return p.longPollUntilChanged(ctx, keys, before, waitIndex)
+}
+
+func (p *metadataProvider) pollUntilChanged(ctx context.Context, keys []string, before map[string]string, waitIndex string) (string, error) {
+	ticker := time.NewTicker(p.refreshSeconds)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return waitIndex, ctx.Err()
+		case <-ticker.C:
+			after, err := p.fetchKeys(ctx, keys)
+			if err != nil {
+				return waitIndex, err
+			}
+			if keysChanged(before, after) {
+				return waitIndex, nil
+			}
+		}
+	}
+}
+
+func (p *metadataProvider) longPollUntilChanged(ctx context.Context, keys []string, before map[string]string, waitIndex string) (string, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return waitIndex, err
+		}
+
+		prevIndex := waitIndex
+		_, newIndex, err := p.doMetaDataRequest(ctx, "/", waitIndex)
+		if err != nil {
+			return waitIndex, err
+		}
+		waitIndex = newIndex
+
+		after, err := p.fetchKeys(ctx, keys)
+		if err != nil {
+			return waitIndex, err
+		}
+		if keysChanged(before, after) {
+			return waitIndex, nil
+		}
+
+		if waitIndex == prevIndex {
+			select {
+			case <-ctx.Done():
+				return waitIndex, ctx.Err()
+			case <-time.After(minLongPollRetryDelay):
+			}
+		}
+	}
+}
+
+// keysChanged reports whether any value in after differs from before.
+func keysChanged(before, after map[string]string) bool {
+	if len(before) != len(after) {
+		return true
+	}
+	for k, v := range after {
+		if bv, ok := before[k]; !ok || bv != v {
+			return true
+		}
+	}
+	return false
+}
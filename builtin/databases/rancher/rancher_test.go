@@ -0,0 +1,93 @@
+package rancher
+
+import "testing"
+
+func TestTreeWalkFlattensNestedValues(t *testing.T) {
+	tree := map[string]interface{}{
+		"name": "web",
+		"labels": map[string]interface{}{
+			"tier": "frontend",
+		},
+		"ports": []interface{}{"80", "443"},
+		"containers": []interface{}{
+			map[string]interface{}{"name": "web-1", "state": "running"},
+		},
+		"healthy": true,
+		"count":   float64(2),
+		"parent":  nil,
+	}
+
+	vars := map[string]string{}
+	if err := treeWalk("/services/web", tree, vars); err != nil {
+		t.Fatalf("treeWalk: %v", err)
+	}
+
+	want := map[string]string{
+		"/services/web/name":                  "web",
+		"/services/web/labels/tier":           "frontend",
+		"/services/web/ports/0":               "80",
+		"/services/web/ports/1":               "443",
+		"/services/web/containers/web-1/name":  "web-1",
+		"/services/web/containers/web-1/state": "running",
+		"/services/web/healthy":                "true",
+		"/services/web/count":                  "2",
+		"/services/web/parent":                 "null",
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf("treeWalk vars[%q] = %q, want %q", k, vars[k], v)
+		}
+	}
+	if len(vars) != len(want) {
+		t.Errorf("treeWalk produced %d vars, want %d (got %v)", len(vars), len(want), vars)
+	}
+}
+
+func TestSubTreeWalksNestedKey(t *testing.T) {
+	tree := map[string]interface{}{
+		"stacks": map[string]interface{}{
+			"myapp": map[string]interface{}{
+				"services": map[string]interface{}{
+					"web": map[string]interface{}{"name": "web"},
+				},
+			},
+		},
+	}
+
+	got, err := subTree(tree, "/stacks/myapp/services/web")
+	if err != nil {
+		t.Fatalf("subTree: %v", err)
+	}
+	m, ok := got.(map[string]interface{})
+	if !ok || m["name"] != "web" {
+		t.Fatalf("subTree = %#v, want the web service map", got)
+	}
+}
+
+func TestSubTreeMissingKeyErrors(t *testing.T) {
+	tree := map[string]interface{}{"stacks": map[string]interface{}{}}
+
+	if _, err := subTree(tree, "/stacks/missing"); err == nil {
+		t.Fatal("subTree(missing key) returned nil error, want an error")
+	}
+}
+
+func TestKeysChanged(t *testing.T) {
+	cases := []struct {
+		name   string
+		before map[string]string
+		after  map[string]string
+		want   bool
+	}{
+		{"identical", map[string]string{"a": "1"}, map[string]string{"a": "1"}, false},
+		{"value changed", map[string]string{"a": "1"}, map[string]string{"a": "2"}, true},
+		{"key added", map[string]string{"a": "1"}, map[string]string{"a": "1", "b": "2"}, true},
+		{"key removed", map[string]string{"a": "1", "b": "2"}, map[string]string{"a": "1"}, true},
+		{"both empty", map[string]string{}, map[string]string{}, false},
+	}
+	for _, c := range cases {
+		if got := keysChanged(c.before, c.after); got != c.want {
+			t.Errorf("%s: keysChanged(%v, %v) = %v, want %v", c.name, c.before, c.after, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Package fetch provides a small worker pool that backend clients can use to
+// parallelize GetValues across many key prefixes. Prefixes are routed to
+// workers via a consistent-hash ring so the same prefix always lands on the
+// same worker, letting each worker keep a per-prefix version cache (an ETag,
+// a Kinesis/SSM version, a ZK Stat.Mzxid, ...) and skip re-fetching subtrees
+// that haven't changed.
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// FetchFunc fetches a single prefix. prevVersion is the version this pool
+// last observed for that prefix (empty on the first call for it). When the
+// implementation can cheaply tell the subtree hasn't changed since
+// prevVersion, it should return a nil values map together with prevVersion
+// unchanged; the pool then reuses its cached values instead of merging an
+// empty result.
+type FetchFunc func(ctx context.Context, prefix, prevVersion string) (values map[string]string, version string, err error)
+
+// Pool distributes GetValues calls for a list of prefixes across a fixed
+// number of workers.
+type Pool struct {
+	fetch   FetchFunc
+	ring    *hashRing
+	workers []*worker
+}
+
+type worker struct {
+	mu       sync.Mutex
+	versions map[string]string
+	cached   map[string]map[string]string
+}
+
+// New creates a pool with n workers (n < 1 is treated as 1) that fetch
+// prefixes via fetchOne.
+func New(n int, fetchOne FetchFunc) *Pool {
+	if n < 1 {
+		n = 1
+	}
+	workers := make([]*worker, n)
+	for i := range workers {
+		workers[i] = &worker{
+			versions: map[string]string{},
+			cached:   map[string]map[string]string{},
+		}
+	}
+	return &Pool{
+		fetch:   fetchOne,
+		ring:    newHashRing(n),
+		workers: workers,
+	}
+}
+
+// GetValues fetches every prefix (in parallel, one goroutine per worker that
+// owns at least one of them) and merges the results into a single map.
+func (p *Pool) GetValues(ctx context.Context, prefixes []string) (map[string]string, error) {
+	byWorker := make([][]string, len(p.workers))
+	for _, prefix := range prefixes {
+		idx := p.ring.workerFor(prefix)
+		byWorker[idx] = append(byWorker[idx], prefix)
+	}
+
+	results := make([]map[string]string, len(p.workers))
+	errs := make([]error, len(p.workers))
+
+	var wg sync.WaitGroup
+	for i, assigned := range byWorker {
+		if len(assigned) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, assigned []string) {
+			defer wg.Done()
+			results[i], errs[i] = p.workers[i].fetchPrefixes(ctx, assigned, p.fetch)
+		}(i, assigned)
+	}
+	wg.Wait()
+
+	merged := map[string]string{}
+	var firstErr error
+	for i, err := range errs {
+		for k, v := range results[i] {
+			merged[k] = v
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return merged, firstErr
+}
+
+// fetchPrefixes fetches each of the worker's assigned prefixes in turn,
+// returning whatever it managed to merge so far alongside the first error
+// encountered (callers get partial results on a mid-batch failure, matching
+// the old sequential GetValues behavior).
+func (w *worker) fetchPrefixes(ctx context.Context, prefixes []string, fetch FetchFunc) (map[string]string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	merged := map[string]string{}
+	for _, prefix := range prefixes {
+		if err := ctx.Err(); err != nil {
+			return merged, err
+		}
+
+		prevVersion := w.versions[prefix]
+		values, version, err := fetch(ctx, prefix, prevVersion)
+		if err != nil {
+			return merged, err
+		}
+
+		if values == nil && prevVersion != "" && version == prevVersion {
+			for k, v := range w.cached[prefix] {
+				merged[k] = v
+			}
+			continue
+		}
+
+		w.versions[prefix] = version
+		w.cached[prefix] = values
+		for k, v := range values {
+			merged[k] = v
+		}
+	}
+	return merged, nil
+}
+
+// hashRing is a consistent-hash ring over a fixed set of worker indexes,
+// used so a given prefix always routes to the same worker across calls
+// (stable caching) without every worker needing to agree on a shared cache.
+type hashRing struct {
+	points []uint32
+	owner  map[uint32]int
+}
+
+const vnodesPerWorker = 64
+
+func newHashRing(workers int) *hashRing {
+	r := &hashRing{owner: map[uint32]int{}}
+	for w := 0; w < workers; w++ {
+		for v := 0; v < vnodesPerWorker; v++ {
+			h := hashKey(vnodeKey(w, v))
+			r.points = append(r.points, h)
+			r.owner[h] = w
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+func (r *hashRing) workerFor(key string) int {
+	h := hashKey(key)
+	idx := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if idx == len(r.points) {
+		idx = 0
+	}
+	return r.owner[r.points[idx]]
+}
+
+func vnodeKey(worker, vnode int) string {
+	return fmt.Sprintf("w%d-v%d", worker, vnode)
+}
+
+func hashKey(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
@@ -0,0 +1,123 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestHashRingStableRouting(t *testing.T) {
+	ring := newHashRing(4)
+
+	prefixes := []string{"/app/a", "/app/b", "/app/c", "/db/host", "/db/port"}
+	first := make(map[string]int, len(prefixes))
+	for _, p := range prefixes {
+		first[p] = ring.workerFor(p)
+	}
+
+	for i := 0; i < 100; i++ {
+		for _, p := range prefixes {
+			if got := ring.workerFor(p); got != first[p] {
+				t.Fatalf("workerFor(%q) = %d on repeat call, want %d (stable assignment)", p, got, first[p])
+			}
+		}
+	}
+
+	// A fresh ring built with the same worker count must route the same
+	// prefix to the same worker, since the ring is derived purely from the
+	// worker count, not call history.
+	other := newHashRing(4)
+	for _, p := range prefixes {
+		if got := other.workerFor(p); got != first[p] {
+			t.Fatalf("workerFor(%q) = %d on a fresh ring, want %d (deterministic from worker count)", p, got, first[p])
+		}
+	}
+}
+
+func TestPoolGetValuesCacheHitOnNilValues(t *testing.T) {
+	ctx := context.Background()
+	calls := 0
+	fetch := func(ctx context.Context, prefix, prevVersion string) (map[string]string, string, error) {
+		calls++
+		if prevVersion == "v1" {
+			// Unchanged: signal a cache hit with a nil values map.
+			return nil, "v1", nil
+		}
+		return map[string]string{"/a": "1"}, "v1", nil
+	}
+
+	p := New(1, fetch)
+
+	first, err := p.GetValues(ctx, []string{"/a"})
+	if err != nil {
+		t.Fatalf("first GetValues: %v", err)
+	}
+	if first["/a"] != "1" {
+		t.Fatalf("first GetValues = %v, want /a=1", first)
+	}
+
+	second, err := p.GetValues(ctx, []string{"/a"})
+	if err != nil {
+		t.Fatalf("second GetValues: %v", err)
+	}
+	if second["/a"] != "1" {
+		t.Fatalf("second GetValues = %v, want cached /a=1 reused on nil-values cache hit", second)
+	}
+	if calls != 2 {
+		t.Fatalf("fetch called %d times, want 2 (one per GetValues call)", calls)
+	}
+}
+
+func TestPoolGetValuesEmptyMapIsNotACacheHit(t *testing.T) {
+	ctx := context.Background()
+	fetch := func(ctx context.Context, prefix, prevVersion string) (map[string]string, string, error) {
+		if prevVersion == "v1" {
+			// Same version as before, but a non-nil empty map: this must be
+			// taken at face value (the prefix is now empty), not confused
+			// with the nil-values cache-hit sentinel.
+			return map[string]string{}, "v1", nil
+		}
+		return map[string]string{"/a": "1"}, "v1", nil
+	}
+
+	p := New(1, fetch)
+
+	if _, err := p.GetValues(ctx, []string{"/a"}); err != nil {
+		t.Fatalf("first GetValues: %v", err)
+	}
+
+	second, err := p.GetValues(ctx, []string{"/a"})
+	if err != nil {
+		t.Fatalf("second GetValues: %v", err)
+	}
+	if _, ok := second["/a"]; ok {
+		t.Fatalf("second GetValues = %v, want /a absent (empty map is a real result, not a cache hit)", second)
+	}
+}
+
+func TestPoolGetValuesPartialResultsOnError(t *testing.T) {
+	ctx := context.Background()
+	boom := errors.New("boom")
+	fetch := func(ctx context.Context, prefix, prevVersion string) (map[string]string, string, error) {
+		if prefix == "/bad" {
+			return nil, "", boom
+		}
+		return map[string]string{prefix: "ok"}, "v1", nil
+	}
+
+	// A single worker processes every prefix sequentially, so prefixes
+	// ordered before /bad must still show up in the merged result even
+	// though the batch as a whole errors out.
+	p := New(1, fetch)
+
+	got, err := p.GetValues(ctx, []string{"/good1", "/bad", "/good2"})
+	if err != boom {
+		t.Fatalf("GetValues err = %v, want %v", err, boom)
+	}
+	if got["/good1"] != "ok" {
+		t.Fatalf("GetValues = %v, want /good1 merged despite later error", got)
+	}
+	if _, ok := got["/good2"]; ok {
+		t.Fatalf("GetValues = %v, want /good2 absent (never fetched, batch stopped at /bad)", got)
+	}
+}